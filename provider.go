@@ -1,62 +1,265 @@
 package libdnstemplate
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"strings"
+	"sync"
 	"time"
 	"strconv"
 
 	"github.com/libdns/libdns"
 )
 
+// ErrInconsistentRead is returned by GetRecords when ConsistentReads is set
+// and the zone kept changing for every attempt, or has no SOA serial to
+// check the listing against.
+var ErrInconsistentRead = errors.New("zone changed while reading records")
+
+// ErrAuthFailed is returned when the server rejects LOGIN. It is permanent:
+// callers should not retry until the credentials have been fixed.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// ErrDestructiveNotAllowed is returned by zone-wide destructive operations
+// such as PurgeZone when the call did not set AllowDestructive.
+var ErrDestructiveNotAllowed = errors.New("destructive operation requires AllowDestructive")
+
+// ErrFreezeFailed is returned by Freeze and Thaw when the server rejects the
+// command, typically because it does not support freezing zones.
+var ErrFreezeFailed = errors.New("zone freeze/thaw rejected")
+
 type Provider struct {
 	Host string `json:"host,omitempty"`
 	User string `json:"user,omitempty"`
 	Pass string `json:"pass,omitempty"`
+
+	// ConsistentReads makes GetRecords compare the zone's SOA serial before
+	// and after listing and retry when it changed in between.
+	ConsistentReads bool `json:"consistent_reads,omitempty"`
+	// ReadRetries caps the retries made for ConsistentReads. 0 means the
+	// default of 3; use a negative value to disable retries.
+	ReadRetries int `json:"read_retries,omitempty"`
+	// AuthFailureCooldown is how long a rejected LOGIN is remembered before
+	// the same credentials are tried again (default 1 minute, negative
+	// disables the cache).
+	AuthFailureCooldown time.Duration `json:"auth_failure_cooldown,omitempty"`
+	// FreezeThreshold, when positive, makes SetRecords and PurgeZone freeze
+	// the zone around batches of at least this many records so resolvers
+	// never see a half-applied change. See Freeze.
+	FreezeThreshold int `json:"freeze_threshold,omitempty"`
+
+	mu sync.Mutex
+	// bulkUnsupported holds the hosts that answered BULKADD with an
+	// unknown-command status
+	bulkUnsupported map[string]bool
+
+	authFailedAt  time.Time
+	authFailedKey string
+
+	// dial replaces net.Dial in tests
+	dial func(network, address string) (net.Conn, error)
 }
 
-func (p *Provider) sendCommand(conn net.Conn, command string) (string, error) {
-	_, err := conn.Write([]byte(command + "\n"))
-	if err != nil {
+// commandTimeout bounds how long the server may take to send a reply line.
+const commandTimeout = 30 * time.Second
+
+// Reply codes of the ODS protocol. Every command has its own success code,
+// so replies are checked against the code of the command that was sent.
+const (
+	statusLoginOK  = "225"
+	statusRecord   = "151" // one line per record in a LISTRR reply
+	statusAddOK    = "795"
+	statusDeleteOK = "901"
+)
+
+// Reply codes of the optional BULKADD, FREEZE and THAW extensions.
+const (
+	statusBulkReady = "354" // BULKADD accepted, send the ADDRR lines
+	statusZoneOK    = "250" // FREEZE or THAW applied
+)
+
+// odsConn is a server connection with a buffered reader so replies can be
+// read one line at a time.
+type odsConn struct {
+	net.Conn
+	r *bufio.Reader
+	// err is set once the connection can no longer be trusted to pair
+	// commands with their replies
+	err error
+}
+
+// fail closes conn and makes every later command on it return err.
+func (conn *odsConn) fail(err error) {
+	if conn.err == nil {
+		conn.err = err
+		conn.Close()
+	}
+}
+
+// readLine reads one reply line without its line ending.
+func (conn *odsConn) readLine() (string, error) {
+	if conn.err != nil {
+		return "", conn.err
+	}
+	if err := conn.SetDeadline(time.Now().Add(commandTimeout)); err != nil {
+		conn.fail(err)
 		return "", err
 	}
 
-	buffer := make([]byte, 4096)
-	n, err := conn.Read(buffer)
+	line, err := conn.r.ReadString('\n')
 	if err != nil {
+		conn.fail(err)
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (conn *odsConn) writeLine(line string) error {
+	if conn.err != nil {
+		return conn.err
+	}
+	if err := conn.SetDeadline(time.Now().Add(commandTimeout)); err != nil {
+		conn.fail(err)
+		return err
+	}
+
+	if _, err := conn.Write([]byte(line + "\n")); err != nil {
+		conn.fail(err)
+		return err
+	}
+	return nil
+}
+
+// sendCommand sends command and returns its single-line reply. An I/O error
+// leaves the reply unread, so it also retires conn.
+func (p *Provider) sendCommand(conn *odsConn, command string) (string, error) {
+	if err := conn.writeLine(command); err != nil {
 		return "", err
 	}
 
-	response := string(buffer[:n])
-	return response, nil
+	return conn.readLine()
+}
+
+// listCommand sends a LISTRR command and returns the body of each 151 line
+// along with the status line that closes the listing.
+func (p *Provider) listCommand(conn *odsConn, command string) (records []string, closing string, err error) {
+	if err := conn.writeLine(command); err != nil {
+		return nil, "", err
+	}
+
+	for {
+		line, err := conn.readLine()
+		if err != nil {
+			return nil, "", err
+		}
+		switch lineStatus(line) {
+		case statusRecord:
+			records = append(records, line[4:])
+		case "":
+			// Not a status line
+		default:
+			return records, line, nil
+		}
+	}
+}
+
+// lineStatus returns the three-digit status code line starts with, or "" if
+// it is not a status line.
+func lineStatus(line string) string {
+	if len(line) < 3 {
+		return ""
+	}
+	for _, c := range line[:3] {
+		if c < '0' || c > '9' {
+			return ""
+		}
+	}
+	if len(line) > 3 && line[3] != ' ' {
+		return ""
+	}
+	return line[:3]
+}
+
+// replyIs reports whether reply carries the status code code.
+func replyIs(reply, code string) bool {
+	return lineStatus(reply) == code
+}
+
+// unknownCommand reports whether the server rejected a command because it
+// does not implement it.
+func unknownCommand(reply string) bool {
+	code := lineStatus(reply)
+	return code == "500" || code == "502"
 }
 
-func (p *Provider) connect() (net.Conn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", p.Host, 7070))
+func (p *Provider) connect() (*odsConn, error) {
+	if err := p.checkAuthCooldown(); err != nil {
+		return nil, err
+	}
+
+	dial := p.dial
+	if dial == nil {
+		dial = net.Dial
+	}
+	nc, err := dial("tcp", net.JoinHostPort(p.Host, "7070"))
 	if err != nil {
 		return nil, err
 	}
+	conn := &odsConn{Conn: nc, r: bufio.NewReader(nc)}
 
 	// Skip the initial banner message
-	_, err = p.sendCommand(conn, "")
-	if err != nil {
+	if _, err := conn.readLine(); err != nil {
 		conn.Close()
 		return nil, err
 	}
 
 	// Log in
 	response, err := p.sendCommand(conn, fmt.Sprintf("LOGIN %s %s", p.User, p.Pass))
-	if err != nil || !strings.Contains(response, "225") {
+	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("login failed: %s", response)
+		return nil, fmt.Errorf("login failed: %w", err)
+	}
+	// The server's rejection codes aren't known, so any reply other than
+	// 225 counts as a rejection; connection errors above do not
+	if !replyIs(response, statusLoginOK) {
+		conn.Close()
+		p.mu.Lock()
+		p.authFailedAt = time.Now()
+		p.authFailedKey = p.credentialKey()
+		p.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrAuthFailed, response)
 	}
 
 	return conn, nil
 }
 
+func (p *Provider) credentialKey() string {
+	return p.Host + "\x00" + p.User + "\x00" + p.Pass
+}
+
+// checkAuthCooldown returns ErrAuthFailed without contacting the server if
+// the same credentials were rejected within AuthFailureCooldown.
+func (p *Provider) checkAuthCooldown() error {
+	cooldown := p.AuthFailureCooldown
+	if cooldown == 0 {
+		cooldown = time.Minute
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cooldown < 0 || p.authFailedAt.IsZero() || p.authFailedKey != p.credentialKey() {
+		return nil
+	}
+	if time.Since(p.authFailedAt) < cooldown {
+		return fmt.Errorf("%w: credentials rejected %s ago", ErrAuthFailed, time.Since(p.authFailedAt).Round(time.Second))
+	}
+	return nil
+}
+
 func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record, error) {
 	conn, err := p.connect()
 	if err != nil {
@@ -64,20 +267,78 @@ func (p *Provider) GetRecords(ctx context.Context, zone string) ([]libdns.Record
 	}
 	defer conn.Close()
 
-	// Adjust command as necessary based on actual requirements
-	response, err := p.sendCommand(conn, fmt.Sprintf("LISTRR %s", zone))
+	if !p.ConsistentReads {
+		return p.listRecords(conn, zone)
+	}
+
+	retries := p.ReadRetries
+	if retries == 0 {
+		retries = 3
+	} else if retries < 0 {
+		retries = 0
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		before, ok, err := p.zoneSerial(conn, zone)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			// Without a serial the listing can't be verified
+			return nil, fmt.Errorf("%w: no SOA serial for %s", ErrInconsistentRead, zone)
+		}
+		records, err := p.listRecords(conn, zone)
+		if err != nil {
+			return nil, err
+		}
+		after, ok, err := p.zoneSerial(conn, zone)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%w: no SOA serial for %s after listing", ErrInconsistentRead, zone)
+		}
+		if before == after {
+			return records, nil
+		}
+	}
+
+	return nil, ErrInconsistentRead
+}
+
+// zoneSerial reads the serial from the zone's SOA record. ok is false if the
+// server did not return a SOA record with a parsable serial.
+func (p *Provider) zoneSerial(conn *odsConn, zone string) (serial uint32, ok bool, err error) {
+	lines, _, err := p.listCommand(conn, fmt.Sprintf("LISTRR %s SOA", zone))
 	if err != nil {
-		return nil, err
+		return 0, false, err
 	}
 
-	lines := strings.Split(response, "\n")
-	var records []libdns.Record
 	for _, line := range lines {
-		if !strings.HasPrefix(line, "151") {
+		// domain SOA mname rname serial refresh retry expire minimum
+		parts := strings.Fields(line)
+		if len(parts) < 5 || parts[1] != "SOA" {
+			continue
+		}
+		n, err := strconv.ParseUint(parts[4], 10, 32)
+		if err != nil {
 			continue
 		}
+		return uint32(n), true, nil
+	}
 
-		parts := strings.Fields(line[4:])
+	return 0, false, nil
+}
+
+func (p *Provider) listRecords(conn *odsConn, zone string) ([]libdns.Record, error) {
+	// Adjust command as necessary based on actual requirements
+	lines, _, err := p.listCommand(conn, fmt.Sprintf("LISTRR %s", zone))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []libdns.Record
+	for _, line := range lines {
+		parts := strings.Fields(line)
 		if len(parts) < 3 {
 			continue // Not enough parts to form a record
 		}
@@ -135,12 +396,33 @@ func (p *Provider) AppendRecords(ctx context.Context, zone string, records []lib
 	}
 	defer conn.Close()
 
+	return p.addRecords(conn, zone, records)
+}
+
+func addCommand(zone string, record libdns.Record) string {
+	return fmt.Sprintf("ADDRR %s.%s %s %s", record.Name, zone, record.Type, record.Value)
+}
+
+// addRecords adds records over conn, using a single BULKADD when the server
+// supports it and falling back to one ADDRR per record otherwise. Records
+// the server rejects are logged and left out of the result; an I/O error
+// ends the batch.
+func (p *Provider) addRecords(conn *odsConn, zone string, records []libdns.Record) ([]libdns.Record, error) {
+	if len(records) > 1 {
+		added, handled, err := p.bulkAdd(conn, zone, records)
+		if handled || err != nil {
+			return added, err
+		}
+	}
+
 	var addedRecords []libdns.Record
 	for _, record := range records {
-		command := fmt.Sprintf("ADDRR %s.%s %s %s", record.Name, zone, record.Type, record.Value)
-		_, err := p.sendCommand(conn, command)
+		response, err := p.sendCommand(conn, addCommand(zone, record))
 		if err != nil {
-			log.Printf("Failed to add record: %v", err)
+			return addedRecords, err
+		}
+		if !replyIs(response, statusAddOK) {
+			log.Printf("Failed to add record: %s", response)
 			continue
 		}
 
@@ -150,6 +432,58 @@ func (p *Provider) AppendRecords(ctx context.Context, zone string, records []lib
 	return addedRecords, nil
 }
 
+// bulkAdd announces the number of records with BULKADD and, if the server
+// accepts it, sends every ADDRR line in one write and reads the single
+// reply the server sends once all lines are in. Hosts that don't know
+// BULKADD are remembered so they are only probed once; other refusals, such
+// as a batch being too large, are not cached. handled is false when BULKADD
+// was refused before any record was sent, so the caller may fall back to
+// per-record commands.
+//
+// Once the records are sent there is no safe fallback: the server may have
+// applied some of them, and ADDRR would add those again. A rejected or
+// unread batch therefore retires conn and reports nothing as applied.
+func (p *Provider) bulkAdd(conn *odsConn, zone string, records []libdns.Record) (added []libdns.Record, handled bool, err error) {
+	p.mu.Lock()
+	unsupported := p.bulkUnsupported[p.Host]
+	p.mu.Unlock()
+	if unsupported {
+		return nil, false, nil
+	}
+
+	response, err := p.sendCommand(conn, fmt.Sprintf("BULKADD %d", len(records)))
+	if err != nil {
+		return nil, true, err
+	}
+	if unknownCommand(response) {
+		p.mu.Lock()
+		if p.bulkUnsupported == nil {
+			p.bulkUnsupported = make(map[string]bool)
+		}
+		p.bulkUnsupported[p.Host] = true
+		p.mu.Unlock()
+	}
+	if !replyIs(response, statusBulkReady) {
+		return nil, false, nil
+	}
+
+	lines := make([]string, len(records))
+	for i, record := range records {
+		lines[i] = addCommand(zone, record)
+	}
+	response, err = p.sendCommand(conn, strings.Join(lines, "\n"))
+	if err != nil {
+		return nil, true, fmt.Errorf("bulk add of %d records: %w", len(records), err)
+	}
+	if !replyIs(response, statusAddOK) {
+		err := fmt.Errorf("bulk add of %d records rejected: %s", len(records), response)
+		conn.fail(err)
+		return nil, true, err
+	}
+
+	return records, true, nil
+}
+
 func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
 	conn, err := p.connect()
 	if err != nil {
@@ -157,21 +491,91 @@ func (p *Provider) SetRecords(ctx context.Context, zone string, records []libdns
 	}
 	defer conn.Close()
 
+	// Assuming ADDRR is used for both adding and updating records
 	var updatedRecords []libdns.Record
-	for _, record := range records {
-		// Assuming ADDRR is used for both adding and updating records
-		// Special handling for SRV records as an example
-		command := fmt.Sprintf("ADDRR %s.%s %s %s", record.Name, zone, record.Type, record.Value)
+	err = p.withFreeze(conn, zone, len(records), func() (err error) {
+		updatedRecords, err = p.addRecords(conn, zone, records)
+		return err
+	})
 
-		if _, err := p.sendCommand(conn, command); err != nil {
-			log.Printf("Failed to set record: %v", err)
-			continue
+	return updatedRecords, err
+}
+
+// Freeze holds what the server publishes for zone: resolvers keep getting
+// the pre-freeze data while writes from any connection are accepted and
+// staged until Thaw publishes them together. The freeze belongs to the
+// zone, not to the connection that set it, so Freeze, SetRecords and Thaw
+// may be called separately.
+func (p *Provider) Freeze(ctx context.Context, zone string) error {
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return p.zoneCommand(conn, "FREEZE", zone)
+}
+
+// Thaw publishes the changes staged since Freeze and ends the freeze. It can
+// be sent from any connection.
+func (p *Provider) Thaw(ctx context.Context, zone string) error {
+	conn, err := p.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return p.zoneCommand(conn, "THAW", zone)
+}
+
+func (p *Provider) zoneCommand(conn *odsConn, command, zone string) error {
+	response, err := p.sendCommand(conn, fmt.Sprintf("%s %s", command, zone))
+	if err != nil {
+		return err
+	}
+	if !replyIs(response, statusZoneOK) {
+		return fmt.Errorf("%w: %s %s: %s", ErrFreezeFailed, command, zone, response)
+	}
+	return nil
+}
+
+// withFreeze runs fn with zone frozen when n reaches FreezeThreshold. If the
+// server refuses to freeze, fn is not run and the error is returned. THAW is
+// sent even if fn fails or panics, on a fresh connection if conn broke; if
+// that fails too the error is returned so the caller knows the zone is still
+// frozen.
+func (p *Provider) withFreeze(conn *odsConn, zone string, n int, fn func() error) (err error) {
+	if p.FreezeThreshold <= 0 || n < p.FreezeThreshold {
+		return fn()
+	}
+
+	if err := p.zoneCommand(conn, "FREEZE", zone); err != nil {
+		return err
+	}
+	defer func() {
+		if thawErr := p.thaw(conn, zone); thawErr != nil {
+			if err != nil {
+				log.Printf("Failed to apply changes to frozen zone: %v", err)
+			}
+			err = thawErr
 		}
+	}()
+
+	return fn()
+}
 
-		updatedRecords = append(updatedRecords, record)
+func (p *Provider) thaw(conn *odsConn, zone string) error {
+	err := p.zoneCommand(conn, "THAW", zone)
+	if err == nil || errors.Is(err, ErrFreezeFailed) {
+		return err
 	}
 
-	return updatedRecords, nil
+	// The freeze is zone-wide, so any connection can end it
+	log.Printf("Failed to thaw zone, retrying on a new connection: %v", err)
+	if err := p.Thaw(context.Background(), zone); err != nil {
+		return fmt.Errorf("zone %s left frozen: %w", zone, err)
+	}
+	return nil
 }
 
 func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []libdns.Record) ([]libdns.Record, error) {
@@ -186,8 +590,12 @@ func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []lib
 		command := fmt.Sprintf("DELRR %s.%s %s %s", record.Name, zone, record.Type, record.Value)
 
 		// The protocol seems to support deleting by host and optionally by record type and target
-		if _, err := p.sendCommand(conn, command); err != nil {
-			log.Printf("Failed to delete record: %v", err)
+		response, err := p.sendCommand(conn, command)
+		if err != nil {
+			return deletedRecords, err
+		}
+		if !replyIs(response, statusDeleteOK) {
+			log.Printf("Failed to delete record: %s", response)
 			continue
 		}
 
@@ -197,6 +605,91 @@ func (p *Provider) DeleteRecords(ctx context.Context, zone string, records []lib
 	return deletedRecords, nil
 }
 
+// PurgeOptions confirms a PurgeZone call. They are per call on purpose, so
+// no provider configuration can make purges run unconfirmed.
+type PurgeOptions struct {
+	// AllowDestructive must be set for records to be deleted.
+	AllowDestructive bool
+	// DryRun returns the records that would be deleted without deleting.
+	DryRun bool
+}
+
+// PurgeZone deletes every record in zone except SOA and NS, which the zone
+// needs to keep being served. With DryRun, or without AllowDestructive,
+// nothing is deleted and the records that would be are returned; the latter
+// also returns ErrDestructiveNotAllowed.
+//
+// Deletion works on whole RRsets (DELRR name type), so a record added to a
+// listed name and type after the listing is deleted as well, without being
+// in the preview or the result.
+func (p *Provider) PurgeZone(ctx context.Context, zone string, opts PurgeOptions) ([]libdns.Record, error) {
+	conn, err := p.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	records, err := p.listRecords(conn, zone)
+	if err != nil {
+		return nil, err
+	}
+
+	var purge []libdns.Record
+	hasSOA := false
+	for _, record := range records {
+		if record.Type == "SOA" || record.Type == "NS" {
+			hasSOA = hasSOA || record.Type == "SOA"
+			continue
+		}
+		purge = append(purge, record)
+	}
+	// LISTRR's closing status doesn't tell an unknown zone from an empty
+	// one, but every served zone has an SOA record
+	if !hasSOA {
+		return nil, fmt.Errorf("zone %s not found: no SOA record listed", zone)
+	}
+
+	if opts.DryRun {
+		return purge, nil
+	}
+	if !opts.AllowDestructive {
+		return purge, ErrDestructiveNotAllowed
+	}
+
+	// Delete by name and type only: every record of the set goes anyway, and
+	// listed values aren't always in the form DELRR expects (e.g. MX)
+	type rrset struct{ name, typ string }
+	var order []rrset
+	sets := make(map[rrset][]libdns.Record)
+	for _, record := range purge {
+		key := rrset{record.Name, record.Type}
+		if _, seen := sets[key]; !seen {
+			order = append(order, key)
+		}
+		sets[key] = append(sets[key], record)
+	}
+
+	var deletedRecords []libdns.Record
+	err = p.withFreeze(conn, zone, len(purge), func() error {
+		for _, key := range order {
+			// Listed names are already fully qualified
+			response, err := p.sendCommand(conn, fmt.Sprintf("DELRR %s %s", key.name, key.typ))
+			if err != nil {
+				return err
+			}
+			if !replyIs(response, statusDeleteOK) {
+				log.Printf("Failed to purge %s %s: %s", key.name, key.typ, response)
+				continue
+			}
+
+			deletedRecords = append(deletedRecords, sets[key]...)
+		}
+		return nil
+	})
+
+	return deletedRecords, err
+}
+
 var (
 	_ libdns.RecordGetter   = (*Provider)(nil)
 	_ libdns.RecordAppender = (*Provider)(nil)
@@ -0,0 +1,315 @@
+package libdnstemplate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/libdns/libdns"
+)
+
+// fakeServer speaks the ODS line protocol over net.Pipe connections.
+type fakeServer struct {
+	// login is the reply to LOGIN; defaults to a 225 success
+	login string
+	// handle returns the reply lines for any other command
+	handle func(cmd string) []string
+
+	mu       sync.Mutex
+	commands []string
+}
+
+func (f *fakeServer) provider() *Provider {
+	p := &Provider{Host: "ods.test", User: "user", Pass: "pass"}
+	p.dial = func(network, address string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go f.serve(server)
+		return client, nil
+	}
+	return p
+}
+
+func (f *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("100 ODS server ready\n")); err != nil {
+		return
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimRight(line, "\r\n")
+
+		f.mu.Lock()
+		f.commands = append(f.commands, cmd)
+		f.mu.Unlock()
+
+		var replies []string
+		if strings.HasPrefix(cmd, "LOGIN ") {
+			replies = []string{"225 Login successful"}
+			if f.login != "" {
+				replies = []string{f.login}
+			}
+		} else if f.handle != nil {
+			replies = f.handle(cmd)
+		}
+		for _, reply := range replies {
+			if _, err := conn.Write([]byte(reply + "\n")); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeServer) sent(prefix string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, cmd := range f.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestGetRecordsReadsWholeListing(t *testing.T) {
+	f := &fakeServer{handle: func(cmd string) []string {
+		switch cmd {
+		case "LISTRR example.com":
+			return []string{
+				"151 example.com SOA ns.example.com hostmaster.example.com 7 3600 600 86400 300",
+				"151 www.example.com A 192.0.2.1:300",
+				"151 www.example.com A 192.0.2.2:300",
+				"150 End of list",
+			}
+		case "LISTRR example.com SOA":
+			return []string{
+				"151 example.com SOA ns.example.com hostmaster.example.com 7 3600 600 86400 300",
+				"150 End of list",
+			}
+		}
+		return []string{"500 Unknown command"}
+	}}
+	p := f.provider()
+	p.ConsistentReads = true
+
+	records, err := p.GetRecords(context.Background(), "example.com")
+	if err != nil {
+		t.Fatalf("GetRecords: %v", err)
+	}
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3: %v", len(records), records)
+	}
+	if records[2].Value != "192.0.2.2" {
+		t.Errorf("last record value = %q, want 192.0.2.2", records[2].Value)
+	}
+}
+
+func TestAppendRecordsChecksADDRRReplies(t *testing.T) {
+	f := &fakeServer{handle: func(cmd string) []string {
+		switch {
+		case strings.HasPrefix(cmd, "BULKADD"):
+			return []string{"500 Unknown command"}
+		case strings.HasPrefix(cmd, "ADDRR bad."):
+			return []string{"796 Invalid record"}
+		case strings.HasPrefix(cmd, "ADDRR"):
+			return []string{"795 Record added"}
+		}
+		return []string{"500 Unknown command"}
+	}}
+	p := f.provider()
+
+	records := []libdns.Record{
+		{Name: "good", Type: "A", Value: "192.0.2.1"},
+		{Name: "bad", Type: "A", Value: "192.0.2.2"},
+	}
+	added, err := p.AppendRecords(context.Background(), "example.com", records)
+	if err != nil {
+		t.Fatalf("AppendRecords: %v", err)
+	}
+	if len(added) != 1 || added[0] != records[0] {
+		t.Errorf("added = %v, want only %v", added, records[0])
+	}
+
+	// BULKADD is unknown to this host, so it isn't probed again
+	if _, err := p.AppendRecords(context.Background(), "example.com", records); err != nil {
+		t.Fatalf("AppendRecords: %v", err)
+	}
+	if n := f.sent("BULKADD"); n != 1 {
+		t.Errorf("sent BULKADD %d times, want 1", n)
+	}
+}
+
+func TestDeleteRecordsChecksDELRRReplies(t *testing.T) {
+	f := &fakeServer{handle: func(cmd string) []string {
+		if strings.HasPrefix(cmd, "DELRR gone.") {
+			return []string{"902 No such record"}
+		}
+		return []string{"901 Record deleted"}
+	}}
+	p := f.provider()
+
+	records := []libdns.Record{
+		{Name: "www", Type: "A", Value: "192.0.2.1"},
+		{Name: "gone", Type: "A", Value: "192.0.2.2"},
+	}
+	deleted, err := p.DeleteRecords(context.Background(), "example.com", records)
+	if err != nil {
+		t.Fatalf("DeleteRecords: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != records[0] {
+		t.Errorf("deleted = %v, want only %v", deleted, records[0])
+	}
+}
+
+func TestBulkAddRejectedBodyReportsNothing(t *testing.T) {
+	body := 0
+	f := &fakeServer{handle: func(cmd string) []string {
+		if strings.HasPrefix(cmd, "BULKADD") {
+			body = 2
+			return []string{"354 Send records"}
+		}
+		if body > 0 {
+			body--
+			if body == 0 {
+				return []string{"797 Batch rejected"}
+			}
+			return nil
+		}
+		return []string{"795 Record added"}
+	}}
+	p := f.provider()
+
+	records := []libdns.Record{
+		{Name: "a", Type: "A", Value: "192.0.2.1"},
+		{Name: "b", Type: "A", Value: "192.0.2.2"},
+	}
+	added, err := p.AppendRecords(context.Background(), "example.com", records)
+	if err == nil {
+		t.Fatal("AppendRecords succeeded, want an error")
+	}
+	if len(added) != 0 {
+		t.Errorf("added = %v, want none", added)
+	}
+	// Only the two lines of the batch; no per-record fallback
+	if n := f.sent("ADDRR"); n != 2 {
+		t.Errorf("sent ADDRR %d times, want 2", n)
+	}
+}
+
+func TestConsistentReadWithoutSerialFails(t *testing.T) {
+	f := &fakeServer{handle: func(cmd string) []string {
+		if cmd == "LISTRR example.com" {
+			return []string{"151 www.example.com A 192.0.2.1:300", "150 End of list"}
+		}
+		return []string{"150 End of list"}
+	}}
+	p := f.provider()
+	p.ConsistentReads = true
+
+	if _, err := p.GetRecords(context.Background(), "example.com"); !errors.Is(err, ErrInconsistentRead) {
+		t.Fatalf("GetRecords error = %v, want ErrInconsistentRead", err)
+	}
+}
+
+func TestLoginRejectionIsCached(t *testing.T) {
+	f := &fakeServer{login: "226 Login failed"}
+	p := f.provider()
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.GetRecords(context.Background(), "example.com"); !errors.Is(err, ErrAuthFailed) {
+			t.Fatalf("GetRecords error = %v, want ErrAuthFailed", err)
+		}
+	}
+	if n := f.sent("LOGIN"); n != 1 {
+		t.Errorf("sent LOGIN %d times, want 1", n)
+	}
+}
+
+func TestPurgeZone(t *testing.T) {
+	f := &fakeServer{handle: func(cmd string) []string {
+		switch {
+		case cmd == "LISTRR example.com":
+			return []string{
+				"151 example.com SOA ns.example.com hostmaster.example.com 7 3600 600 86400 300",
+				"151 example.com NS ns.example.com",
+				"151 www.example.com A 192.0.2.1:300",
+				"151 mail.example.com MX 10 mx.example.com:300",
+				"150 End of list",
+			}
+		case strings.HasPrefix(cmd, "LISTRR"):
+			return []string{"150 End of list"}
+		case cmd == "DELRR mail.example.com MX":
+			return []string{"902 Delete failed"}
+		case strings.HasPrefix(cmd, "DELRR"):
+			return []string{"901 Record deleted"}
+		}
+		return []string{"500 Unknown command"}
+	}}
+	p := f.provider()
+	ctx := context.Background()
+
+	preview, err := p.PurgeZone(ctx, "example.com", PurgeOptions{})
+	if !errors.Is(err, ErrDestructiveNotAllowed) || len(preview) != 2 {
+		t.Fatalf("unconfirmed PurgeZone = %v, %v; want 2 records and ErrDestructiveNotAllowed", preview, err)
+	}
+	if _, err := p.PurgeZone(ctx, "example.com", PurgeOptions{AllowDestructive: true, DryRun: true}); err != nil {
+		t.Fatalf("dry-run PurgeZone: %v", err)
+	}
+	if n := f.sent("DELRR"); n != 0 {
+		t.Fatalf("sent DELRR %d times before confirming, want 0", n)
+	}
+
+	deleted, err := p.PurgeZone(ctx, "example.com", PurgeOptions{AllowDestructive: true})
+	if err != nil {
+		t.Fatalf("PurgeZone: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0].Name != "www.example.com" {
+		t.Errorf("deleted = %v, want only www.example.com", deleted)
+	}
+
+	if _, err := p.PurgeZone(ctx, "exmaple.com", PurgeOptions{AllowDestructive: true}); err == nil {
+		t.Error("PurgeZone of an unknown zone succeeded")
+	}
+}
+
+func TestSetRecordsThawsOnNewConnection(t *testing.T) {
+	f := &fakeServer{handle: func(cmd string) []string {
+		switch {
+		case strings.HasPrefix(cmd, "FREEZE"), strings.HasPrefix(cmd, "THAW"):
+			return []string{"250 OK"}
+		case strings.HasPrefix(cmd, "BULKADD"):
+			return []string{"354 Send records"}
+		case strings.HasPrefix(cmd, "ADDRR b."):
+			return []string{"797 Batch rejected"}
+		}
+		return nil
+	}}
+	p := f.provider()
+	p.FreezeThreshold = 2
+
+	records := []libdns.Record{
+		{Name: "a", Type: "A", Value: "192.0.2.1"},
+		{Name: "b", Type: "A", Value: "192.0.2.2"},
+	}
+	if _, err := p.SetRecords(context.Background(), "example.com", records); err == nil {
+		t.Fatal("SetRecords succeeded, want the rejected batch error")
+	}
+	// The rejected batch retires the connection, so THAW needs a new one
+	if n := f.sent("THAW"); n != 1 {
+		t.Errorf("sent THAW %d times, want 1", n)
+	}
+	if n := f.sent("LOGIN"); n != 2 {
+		t.Errorf("sent LOGIN %d times, want 2", n)
+	}
+}
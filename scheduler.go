@@ -0,0 +1,430 @@
+package libdnstemplate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+// ChangeAction selects which Provider method applies a ScheduledChange.
+type ChangeAction string
+
+const (
+	ActionAppend ChangeAction = "append"
+	ActionSet    ChangeAction = "set"
+	ActionDelete ChangeAction = "delete"
+)
+
+// ScheduledChange is a batch of records to append, set or delete in Zone
+// once ApplyAt has passed.
+type ScheduledChange struct {
+	ID      string          `json:"id"`
+	Zone    string          `json:"zone"`
+	Action  ChangeAction    `json:"action"`
+	Records []libdns.Record `json:"records"`
+	ApplyAt time.Time       `json:"apply_at"`
+}
+
+// ErrChangeInFlight is returned by Cancel when the change is already being
+// applied or saved.
+var ErrChangeInFlight = errors.New("scheduled change is in flight")
+
+// ErrChangeStale is passed to Scheduler.Failed for a change that comes due
+// more than StaleAfter past its ApplyAt, e.g. one restored after downtime.
+var ErrChangeStale = errors.New("scheduled change is past its apply window")
+
+// ErrChangeNotRemoved is passed to Scheduler.Failed when a change was
+// applied but could not be removed from the Store, so it would be applied
+// again after a restart.
+var ErrChangeNotRemoved = errors.New("applied change could not be removed from store")
+
+// ChangeStore persists pending changes so they survive restarts. SaveChange
+// is called when a change is scheduled, and again with the remaining Records
+// when only part of it could be applied; DeleteChange is called once it has
+// been applied or cancelled. Changes the Scheduler gives up on are left in
+// the store.
+type ChangeStore interface {
+	LoadChanges() ([]ScheduledChange, error)
+	SaveChange(change ScheduledChange) error
+	DeleteChange(id string) error
+}
+
+// Scheduler applies ScheduledChanges through its Provider at their ApplyAt
+// time. Changes are only applied while Run is executing. Use NewScheduler
+// to restore pending changes from Store.
+type Scheduler struct {
+	Provider *Provider
+	// Store is optional; without it pending changes live only in memory.
+	Store ChangeStore
+	// RetryInterval is the wait before the first retry of a change that
+	// failed to apply (default 1 minute); it doubles with each attempt.
+	RetryInterval time.Duration
+	// MaxAttempts is how often a change is tried before giving up. 0 means
+	// the default of 5; negative retries forever.
+	MaxAttempts int
+	// StaleAfter is how far past its ApplyAt a change may still be applied.
+	// 0 means the default of 1 hour; negative applies changes however late.
+	StaleAfter time.Duration
+	// Failed, if set, is called when the scheduler gives up on a change:
+	// after ErrAuthFailed, ErrChangeStale or MaxAttempts failures. Such
+	// changes stop being retried but stay in Store; call Store.DeleteChange
+	// to discard one, or Schedule it again to resume it. Failed is also
+	// called with ErrChangeNotRemoved for applied changes Store still holds.
+	Failed func(change ScheduledChange, err error)
+
+	mu       sync.Mutex
+	pending  map[string]ScheduledChange
+	retryAt  map[string]time.Time
+	attempts map[string]int
+	inFlight map[string]bool
+	wake     chan struct{}
+}
+
+// NewScheduler returns a Scheduler for p, restoring any pending changes
+// from store. store may be nil.
+func NewScheduler(p *Provider, store ChangeStore) (*Scheduler, error) {
+	s := &Scheduler{Provider: p, Store: store}
+	s.init()
+
+	if store != nil {
+		changes, err := store.LoadChanges()
+		if err != nil {
+			return nil, fmt.Errorf("loading scheduled changes: %w", err)
+		}
+		for _, change := range changes {
+			s.pending[change.ID] = change
+		}
+	}
+
+	return s, nil
+}
+
+// init creates the internal state of a Scheduler built as a struct literal.
+// Callers hold s.mu, except NewScheduler.
+func (s *Scheduler) init() {
+	if s.pending != nil {
+		return
+	}
+	s.pending = make(map[string]ScheduledChange)
+	s.retryAt = make(map[string]time.Time)
+	s.attempts = make(map[string]int)
+	s.inFlight = make(map[string]bool)
+	s.wake = make(chan struct{}, 1)
+}
+
+// Schedule queues change to be applied at change.ApplyAt. A change whose
+// ApplyAt is already in the past is applied on the next Run iteration.
+func (s *Scheduler) Schedule(change ScheduledChange) error {
+	if change.ID == "" {
+		return errors.New("scheduled change requires an ID")
+	}
+	switch change.Action {
+	case ActionAppend, ActionSet, ActionDelete:
+	default:
+		return fmt.Errorf("unknown scheduled change action %q", change.Action)
+	}
+
+	s.mu.Lock()
+	s.init()
+	if _, exists := s.pending[change.ID]; exists {
+		s.mu.Unlock()
+		return fmt.Errorf("scheduled change %q already exists", change.ID)
+	}
+	// Held in flight until saved so Run doesn't apply it first
+	s.pending[change.ID] = change
+	s.inFlight[change.ID] = true
+	s.mu.Unlock()
+
+	var err error
+	if s.Store != nil {
+		err = s.Store.SaveChange(change)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, change.ID)
+	if err != nil {
+		delete(s.pending, change.ID)
+		return err
+	}
+	s.notify()
+
+	return nil
+}
+
+// Cancel removes a pending change. It returns ErrChangeInFlight if the
+// change is being applied, in which case it will still take effect.
+func (s *Scheduler) Cancel(id string) error {
+	s.mu.Lock()
+	s.init()
+	if _, exists := s.pending[id]; !exists {
+		s.mu.Unlock()
+		return fmt.Errorf("scheduled change %q not found", id)
+	}
+	if s.inFlight[id] {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrChangeInFlight, id)
+	}
+	s.inFlight[id] = true
+	s.mu.Unlock()
+
+	var err error
+	if s.Store != nil {
+		err = s.Store.DeleteChange(id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, id)
+	if err != nil {
+		return err
+	}
+	s.remove(id)
+	s.notify()
+
+	return nil
+}
+
+// Pending returns the changes not yet applied, ordered by ApplyAt.
+func (s *Scheduler) Pending() []ScheduledChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := make([]ScheduledChange, 0, len(s.pending))
+	for _, change := range s.pending {
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].ApplyAt.Before(changes[j].ApplyAt)
+	})
+
+	return changes
+}
+
+// Run applies changes as they come due until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	s.init()
+	wake := s.wake
+	s.mu.Unlock()
+
+	for {
+		for _, change := range s.due(time.Now()) {
+			s.apply(ctx, change)
+		}
+
+		timer := time.NewTimer(s.untilNext(time.Now()))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// notify wakes Run. Callers hold s.mu.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// remove forgets a change. Callers hold s.mu.
+func (s *Scheduler) remove(id string) {
+	delete(s.pending, id)
+	delete(s.retryAt, id)
+	delete(s.attempts, id)
+}
+
+// nextAttempt returns when change should next be tried. Callers hold s.mu.
+func (s *Scheduler) nextAttempt(change ScheduledChange) time.Time {
+	if retry, ok := s.retryAt[change.ID]; ok {
+		return retry
+	}
+	return change.ApplyAt
+}
+
+// due returns the changes ready to apply and marks them in flight.
+func (s *Scheduler) due(now time.Time) []ScheduledChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var due []ScheduledChange
+	for _, change := range s.pending {
+		if !s.inFlight[change.ID] && !s.nextAttempt(change).After(now) {
+			s.inFlight[change.ID] = true
+			due = append(due, change)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ApplyAt.Before(due[j].ApplyAt)
+	})
+
+	return due
+}
+
+func (s *Scheduler) untilNext(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// With nothing pending, sleep until Schedule wakes us
+	wait := 24 * time.Hour
+	for _, change := range s.pending {
+		if s.inFlight[change.ID] {
+			continue
+		}
+		if d := s.nextAttempt(change).Sub(now); d < wait {
+			wait = d
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait
+}
+
+func (s *Scheduler) apply(ctx context.Context, change ScheduledChange) {
+	staleAfter := s.StaleAfter
+	if staleAfter == 0 {
+		staleAfter = time.Hour
+	}
+	if late := time.Since(change.ApplyAt); staleAfter > 0 && late > staleAfter {
+		s.giveUp(change, fmt.Errorf("%w: due %s ago", ErrChangeStale, late.Round(time.Second)))
+		return
+	}
+
+	var applied []libdns.Record
+	var err error
+	switch change.Action {
+	case ActionAppend:
+		applied, err = s.Provider.AppendRecords(ctx, change.Zone, change.Records)
+	case ActionSet:
+		applied, err = s.Provider.SetRecords(ctx, change.Zone, change.Records)
+	case ActionDelete:
+		applied, err = s.Provider.DeleteRecords(ctx, change.Zone, change.Records)
+	}
+
+	// The provider logs and skips records the server rejects, so success is
+	// judged by what it reports as applied rather than by err alone
+	remaining := subtractRecords(change.Records, applied)
+	if len(remaining) == 0 {
+		if err != nil {
+			log.Printf("Scheduled change %s applied with error: %v", change.ID, err)
+		}
+		s.finish(change)
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("%d of %d records not applied", len(remaining), len(change.Records))
+	}
+
+	if len(remaining) < len(change.Records) {
+		// Only retry what is left so applied records aren't written twice
+		change.Records = remaining
+		if s.Store != nil {
+			if err := s.Store.SaveChange(change); err != nil {
+				log.Printf("Failed to save remaining records of change %s: %v", change.ID, err)
+			}
+		}
+	}
+
+	maxAttempts := s.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = 5
+	}
+	s.mu.Lock()
+	s.attempts[change.ID]++
+	attempts := s.attempts[change.ID]
+	s.mu.Unlock()
+
+	if errors.Is(err, ErrAuthFailed) {
+		s.giveUp(change, err)
+		return
+	}
+	if maxAttempts > 0 && attempts >= maxAttempts {
+		s.giveUp(change, fmt.Errorf("giving up after %d attempts: %w", attempts, err))
+		return
+	}
+
+	retry := s.RetryInterval
+	if retry <= 0 {
+		retry = time.Minute
+	}
+	if attempts > 5 {
+		attempts = 5
+	}
+	retry <<= attempts - 1
+	log.Printf("Failed to apply scheduled change %s, retrying in %s: %v", change.ID, retry, err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[change.ID] = change
+	s.retryAt[change.ID] = time.Now().Add(retry)
+	delete(s.inFlight, change.ID)
+}
+
+// finish removes an applied change.
+func (s *Scheduler) finish(change ScheduledChange) {
+	var err error
+	if s.Store != nil {
+		err = s.Store.DeleteChange(change.ID)
+	}
+
+	s.mu.Lock()
+	s.remove(change.ID)
+	delete(s.inFlight, change.ID)
+	s.mu.Unlock()
+
+	if err != nil {
+		s.report(change, fmt.Errorf("%w: %v", ErrChangeNotRemoved, err))
+	}
+}
+
+// giveUp stops retrying change but leaves it in Store, so a restart or a
+// new Schedule call can resume it.
+func (s *Scheduler) giveUp(change ScheduledChange, err error) {
+	s.mu.Lock()
+	s.remove(change.ID)
+	delete(s.inFlight, change.ID)
+	s.mu.Unlock()
+
+	s.report(change, err)
+}
+
+func (s *Scheduler) report(change ScheduledChange, err error) {
+	if s.Failed != nil {
+		s.Failed(change, err)
+	} else {
+		log.Printf("Scheduled change %s failed: %v", change.ID, err)
+	}
+}
+
+// subtractRecords returns the records in want that are not in got.
+func subtractRecords(want, got []libdns.Record) []libdns.Record {
+	seen := make(map[libdns.Record]int, len(got))
+	for _, record := range got {
+		seen[record]++
+	}
+
+	var missing []libdns.Record
+	for _, record := range want {
+		if seen[record] > 0 {
+			seen[record]--
+			continue
+		}
+		missing = append(missing, record)
+	}
+
+	return missing
+}
@@ -0,0 +1,275 @@
+package libdnstemplate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libdns/libdns"
+)
+
+type fakeStore struct {
+	mu      sync.Mutex
+	changes map[string]ScheduledChange
+	saveErr error
+}
+
+func newFakeStore(changes ...ScheduledChange) *fakeStore {
+	st := &fakeStore{changes: make(map[string]ScheduledChange)}
+	for _, change := range changes {
+		st.changes[change.ID] = change
+	}
+	return st
+}
+
+func (st *fakeStore) LoadChanges() ([]ScheduledChange, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var changes []ScheduledChange
+	for _, change := range st.changes {
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+func (st *fakeStore) SaveChange(change ScheduledChange) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.saveErr != nil {
+		return st.saveErr
+	}
+	st.changes[change.ID] = change
+	return nil
+}
+
+func (st *fakeStore) DeleteChange(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.changes, id)
+	return nil
+}
+
+func (st *fakeStore) get(id string) (ScheduledChange, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	change, ok := st.changes[id]
+	return change, ok
+}
+
+// addServer accepts ADDRR for every name except "bad".
+func addServer() *fakeServer {
+	return &fakeServer{handle: func(cmd string) []string {
+		switch {
+		case strings.HasPrefix(cmd, "BULKADD"):
+			return []string{"500 Unknown command"}
+		case strings.HasPrefix(cmd, "ADDRR bad."):
+			return []string{"796 Invalid record"}
+		}
+		return []string{"795 Record added"}
+	}}
+}
+
+func TestSchedulerDueOrder(t *testing.T) {
+	// A struct literal must work without NewScheduler
+	s := &Scheduler{}
+	now := time.Now()
+	for _, change := range []ScheduledChange{
+		{ID: "c", Action: ActionSet, ApplyAt: now.Add(-1 * time.Minute)},
+		{ID: "later", Action: ActionSet, ApplyAt: now.Add(time.Hour)},
+		{ID: "a", Action: ActionSet, ApplyAt: now.Add(-3 * time.Minute)},
+		{ID: "b", Action: ActionSet, ApplyAt: now.Add(-2 * time.Minute)},
+	} {
+		if err := s.Schedule(change); err != nil {
+			t.Fatalf("Schedule(%s): %v", change.ID, err)
+		}
+	}
+
+	var ids []string
+	for _, change := range s.due(now) {
+		ids = append(ids, change.ID)
+	}
+	if got := strings.Join(ids, ","); got != "a,b,c" {
+		t.Errorf("due = %s, want a,b,c", got)
+	}
+	if due := s.due(now); len(due) != 0 {
+		t.Errorf("due returned %d in-flight changes again", len(due))
+	}
+}
+
+func TestSchedulerPartialApplyResavesRemaining(t *testing.T) {
+	store := newFakeStore()
+	s, err := NewScheduler(addServer().provider(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bad := libdns.Record{Name: "bad", Type: "A", Value: "192.0.2.2"}
+	change := ScheduledChange{
+		ID:      "cutover",
+		Zone:    "example.com",
+		Action:  ActionAppend,
+		Records: []libdns.Record{{Name: "good", Type: "A", Value: "192.0.2.1"}, bad},
+		ApplyAt: time.Now(),
+	}
+	if err := s.Schedule(change); err != nil {
+		t.Fatal(err)
+	}
+	for _, due := range s.due(time.Now()) {
+		s.apply(context.Background(), due)
+	}
+
+	stored, ok := store.get("cutover")
+	if !ok || len(stored.Records) != 1 || stored.Records[0] != bad {
+		t.Errorf("stored change = %v, want only %v remaining", stored.Records, bad)
+	}
+	pending := s.Pending()
+	if len(pending) != 1 || len(pending[0].Records) != 1 {
+		t.Errorf("pending = %v, want the change with one record left", pending)
+	}
+}
+
+func TestSchedulerCancelInFlight(t *testing.T) {
+	store := newFakeStore()
+	s, err := NewScheduler(addServer().provider(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Schedule(ScheduledChange{ID: "x", Action: ActionSet, ApplyAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	s.due(time.Now())
+
+	if err := s.Cancel("x"); !errors.Is(err, ErrChangeInFlight) {
+		t.Errorf("Cancel error = %v, want ErrChangeInFlight", err)
+	}
+	if _, ok := store.get("x"); !ok {
+		t.Error("in-flight change was removed from the store")
+	}
+}
+
+func TestSchedulerScheduleSaveFailureRollsBack(t *testing.T) {
+	store := newFakeStore()
+	store.saveErr = errors.New("disk full")
+	s, err := NewScheduler(addServer().provider(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change := ScheduledChange{ID: "x", Action: ActionSet, ApplyAt: time.Now()}
+	if err := s.Schedule(change); err == nil {
+		t.Fatal("Schedule succeeded despite the store failing")
+	}
+	if pending := s.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %v after a failed save, want none", pending)
+	}
+
+	store.saveErr = nil
+	if err := s.Schedule(change); err != nil {
+		t.Errorf("Schedule after rollback: %v", err)
+	}
+}
+
+func TestSchedulerAuthFailureKeepsStoredChange(t *testing.T) {
+	f := &fakeServer{login: "226 Login failed"}
+	store := newFakeStore()
+	s, err := NewScheduler(f.provider(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed error
+	s.Failed = func(change ScheduledChange, err error) { failed = err }
+
+	change := ScheduledChange{
+		ID:      "x",
+		Zone:    "example.com",
+		Action:  ActionSet,
+		Records: []libdns.Record{{Name: "www", Type: "A", Value: "192.0.2.1"}},
+		ApplyAt: time.Now(),
+	}
+	if err := s.Schedule(change); err != nil {
+		t.Fatal(err)
+	}
+	for _, due := range s.due(time.Now()) {
+		s.apply(context.Background(), due)
+	}
+
+	if !errors.Is(failed, ErrAuthFailed) {
+		t.Errorf("Failed called with %v, want ErrAuthFailed", failed)
+	}
+	if len(s.Pending()) != 0 {
+		t.Error("change is still retried after an auth failure")
+	}
+	if _, ok := store.get("x"); !ok {
+		t.Error("change was removed from the store after an auth failure")
+	}
+}
+
+func TestSchedulerSkipsStaleChanges(t *testing.T) {
+	f := addServer()
+	store := newFakeStore(ScheduledChange{
+		ID:      "old",
+		Zone:    "example.com",
+		Action:  ActionSet,
+		Records: []libdns.Record{{Name: "www", Type: "A", Value: "192.0.2.1"}},
+		ApplyAt: time.Now().Add(-72 * time.Hour),
+	})
+	s, err := NewScheduler(f.provider(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failed error
+	s.Failed = func(change ScheduledChange, err error) { failed = err }
+
+	for _, due := range s.due(time.Now()) {
+		s.apply(context.Background(), due)
+	}
+
+	if !errors.Is(failed, ErrChangeStale) {
+		t.Errorf("Failed called with %v, want ErrChangeStale", failed)
+	}
+	if n := f.sent("LOGIN"); n != 0 {
+		t.Errorf("contacted the server %d times for a stale change", n)
+	}
+}
+
+func TestSchedulerGivesUpAfterMaxAttempts(t *testing.T) {
+	s, err := NewScheduler(addServer().provider(), newFakeStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.MaxAttempts = 2
+	failures := 0
+	s.Failed = func(change ScheduledChange, err error) { failures++ }
+
+	change := ScheduledChange{
+		ID:      "x",
+		Zone:    "example.com",
+		Action:  ActionAppend,
+		Records: []libdns.Record{{Name: "bad", Type: "A", Value: "192.0.2.2"}},
+		ApplyAt: time.Now(),
+	}
+	if err := s.Schedule(change); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		// Ignore the retry delay
+		for _, due := range s.due(time.Now().Add(time.Hour)) {
+			s.apply(context.Background(), due)
+		}
+	}
+
+	if failures != 1 {
+		t.Errorf("Failed called %d times, want 1", failures)
+	}
+	if len(s.Pending()) != 0 {
+		t.Error("change is still pending after MaxAttempts")
+	}
+}